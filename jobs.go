@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pamodi/Lab5/scheduler"
+)
+
+// invitationJobPayload is the JSON payload carried by the
+// expire_invitation and resend_invitation jobs below.
+type invitationJobPayload struct {
+	Email string `json:"email"`
+	Code  string `json:"code"`
+}
+
+// SetupScheduler builds the background job scheduler, registers the
+// invitation-related handlers, and schedules the periodic sweep that
+// catches anything an ad-hoc enqueue missed (e.g. a restart between
+// /invite and the expiry job firing).
+func SetupScheduler(db *sql.DB) *scheduler.Scheduler {
+	sched := scheduler.New(db, 10*time.Second)
+
+	sched.Register("expire_invitation", handleExpireInvitation)
+	sched.Register("resend_invitation", handleResendInvitation)
+	sched.Register("sweep_expired_invitations", handleSweepExpiredInvitations)
+
+	if err := sched.AddCron("*/15 * * * *", "sweep_expired_invitations", ""); err != nil {
+		fmt.Println("Error scheduling invitation sweep:", err)
+	}
+
+	return sched
+}
+
+// enqueueExpireInvitation schedules a one-off check of whether
+// email/code is still unused at runAt (normally invitationTTL after it
+// was issued), so an ignored invitation gets a reminder without relying
+// on anyone polling for it.
+func enqueueExpireInvitation(email, code string, runAt time.Time) error {
+	payload, err := json.Marshal(invitationJobPayload{Email: email, Code: code})
+	if err != nil {
+		return err
+	}
+	return jobScheduler.Enqueue("expire_invitation", string(payload), runAt)
+}
+
+// handleExpireInvitation fires once an invitation's TTL has elapsed. If
+// the code has since been redeemed there's nothing to do; otherwise it
+// hands off to resend_invitation so the reminder email itself can be
+// retried independently of this job.
+func handleExpireInvitation(ctx context.Context, db *sql.DB, payload string) error {
+	var p invitationJobPayload
+	if err := json.Unmarshal([]byte(payload), &p); err != nil {
+		return err
+	}
+
+	var stillUnused bool
+	err := db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM invitation_codes WHERE code=$1 AND email=$2 AND used=false)",
+		p.Code, p.Email,
+	).Scan(&stillUnused)
+	if err != nil {
+		return err
+	}
+	if !stillUnused {
+		return nil
+	}
+
+	return jobScheduler.Enqueue("resend_invitation", payload, time.Now())
+}
+
+// handleResendInvitation sends the reminder email. It re-checks that the
+// code is still unused so a handler retried after a partial failure
+// doesn't reminder a user who registered in between attempts.
+func handleResendInvitation(ctx context.Context, db *sql.DB, payload string) error {
+	var p invitationJobPayload
+	if err := json.Unmarshal([]byte(payload), &p); err != nil {
+		return err
+	}
+
+	var stillUnused bool
+	err := db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM invitation_codes WHERE code=$1 AND email=$2 AND used=false)",
+		p.Code, p.Email,
+	).Scan(&stillUnused)
+	if err != nil {
+		return err
+	}
+	if !stillUnused {
+		return nil
+	}
+
+	return ResendInvitation(Invitation{Email: p.Email, Code: p.Code})
+}
+
+// handleSweepExpiredInvitations is the periodic safety net behind the
+// ad-hoc expire_invitation jobs: it re-enqueues a resend_invitation job
+// for any invitation that's expired and still unused, in case its own
+// expiry job was never scheduled (e.g. it predates this scheduler) or
+// was lost. GetExpiredInvitations only returns invitations that haven't
+// been reminded yet, and each one is marked reminded_at here, so the
+// same invitation gets at most one reminder out of this sweep no matter
+// how many times it fires before it's redeemed.
+func handleSweepExpiredInvitations(ctx context.Context, db *sql.DB, payload string) error {
+	expired, err := GetExpiredInvitations(db)
+	if err != nil {
+		return err
+	}
+
+	for _, invitation := range expired {
+		jobPayload, err := json.Marshal(invitationJobPayload{Email: invitation.Email, Code: invitation.Code})
+		if err != nil {
+			return err
+		}
+		if err := jobScheduler.Enqueue("resend_invitation", string(jobPayload), time.Now()); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "UPDATE invitation_codes SET reminded_at=NOW() WHERE id=$1", invitation.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,232 @@
+// Package mailer sends invitation codes and reminder emails over SMTP.
+//
+// Transports are pluggable behind the Mailer interface so handlers and
+// background jobs don't need to know whether they're talking to a real
+// SMTP server or the NoopMailer used in tests.
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"math/rand"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	texttemplate "text/template"
+	"time"
+)
+
+// Mailer sends a rendered email to a single recipient.
+type Mailer interface {
+	Send(to string, msg Message) error
+}
+
+// Message is a single templated email, rendered as both HTML and
+// plaintext so clients that don't render HTML still get something
+// readable.
+type Message struct {
+	Subject  string
+	HTMLBody string
+	TextBody string
+}
+
+// Config holds the SMTP connection settings and template locations,
+// read from the environment by NewSMTPMailerFromEnv.
+type Config struct {
+	Host        string
+	Port        string
+	Username    string
+	Password    string
+	From        string
+	TemplateDir string
+	MaxRetries  int
+}
+
+// ConfigFromEnv builds a Config from SMTP_* environment variables.
+// Callers that need a different source (tests, flags) can build a
+// Config directly instead.
+func ConfigFromEnv() Config {
+	maxRetries := 3
+	if v := os.Getenv("SMTP_MAX_RETRIES"); v != "" {
+		fmt.Sscanf(v, "%d", &maxRetries)
+	}
+
+	templateDir := os.Getenv("SMTP_TEMPLATE_DIR")
+	if templateDir == "" {
+		templateDir = "mailer/templates"
+	}
+
+	return Config{
+		Host:        os.Getenv("SMTP_HOST"),
+		Port:        os.Getenv("SMTP_PORT"),
+		Username:    os.Getenv("SMTP_USERNAME"),
+		Password:    os.Getenv("SMTP_PASSWORD"),
+		From:        os.Getenv("SMTP_FROM"),
+		TemplateDir: templateDir,
+		MaxRetries:  maxRetries,
+	}
+}
+
+// SMTPMailer sends mail via net/smtp, retrying transient failures with
+// exponential backoff.
+type SMTPMailer struct {
+	cfg  Config
+	auth smtp.Auth
+}
+
+// NewSMTPMailer builds a Mailer that talks to the SMTP server described
+// by cfg.
+func NewSMTPMailer(cfg Config) *SMTPMailer {
+	return &SMTPMailer{
+		cfg:  cfg,
+		auth: smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host),
+	}
+}
+
+// NewSMTPMailerFromEnv is a convenience wrapper around
+// NewSMTPMailer(ConfigFromEnv()).
+func NewSMTPMailerFromEnv() *SMTPMailer {
+	return NewSMTPMailer(ConfigFromEnv())
+}
+
+// Send delivers msg to "to", retrying up to cfg.MaxRetries times with
+// exponential backoff. Every error smtp.SendMail returns is retried;
+// permanent failures are not told apart from transient ones.
+func (m *SMTPMailer) Send(to string, msg Message) error {
+	addr := fmt.Sprintf("%s:%s", m.cfg.Host, m.cfg.Port)
+	body := buildMIMEMessage(m.cfg.From, to, msg)
+
+	var lastErr error
+	backoff := 500 * time.Millisecond
+	for attempt := 0; attempt <= m.cfg.MaxRetries; attempt++ {
+		lastErr = smtp.SendMail(addr, m.auth, m.cfg.From, []string{to}, body)
+		if lastErr == nil {
+			return nil
+		}
+		if attempt == m.cfg.MaxRetries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return fmt.Errorf("mailer: failed to send to %s after %d attempts: %w", to, m.cfg.MaxRetries+1, lastErr)
+}
+
+func buildMIMEMessage(from, to string, msg Message) []byte {
+	boundary := fmt.Sprintf("mail-boundary-%d", rand.Int63())
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	buf.WriteString(msg.TextBody)
+	buf.WriteString("\r\n\r\n")
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	buf.WriteString(msg.HTMLBody)
+	fmt.Fprintf(&buf, "\r\n\r\n--%s--\r\n", boundary)
+
+	return buf.Bytes()
+}
+
+// NoopMailer delivers nothing; it records every message in Sent
+// instead. Tests construct one in place of
+// an SMTPMailer so they don't need a real mail server.
+type NoopMailer struct {
+	Sent []SentMessage
+}
+
+// SentMessage records a call to NoopMailer.Send for assertions in tests.
+type SentMessage struct {
+	To      string
+	Message Message
+}
+
+// NewNoopMailer returns a Mailer that records sends instead of
+// delivering them.
+func NewNoopMailer() *NoopMailer {
+	return &NoopMailer{}
+}
+
+// Send records the message and always succeeds.
+func (m *NoopMailer) Send(to string, msg Message) error {
+	m.Sent = append(m.Sent, SentMessage{To: to, Message: msg})
+	return nil
+}
+
+// Templates renders the invitation and reminder emails from the HTML
+// and plaintext templates on disk.
+type Templates struct {
+	dir string
+}
+
+// NewTemplates loads templates from dir lazily on each Render call, so
+// edits to the templates on disk don't require a restart.
+func NewTemplates(dir string) *Templates {
+	return &Templates{dir: dir}
+}
+
+// InvitationData is the set of fields available to the invitation and
+// reminder templates.
+type InvitationData struct {
+	Email        string
+	Code         string
+	VerifyURL    string
+	ExpiresAfter string
+}
+
+// RenderInvitation renders the "here is your invitation code" email.
+func (t *Templates) RenderInvitation(data InvitationData) (Message, error) {
+	return t.render("invitation", "Your invitation code", data)
+}
+
+// RenderReminder renders the follow-up reminder email sent when an
+// invitation code is about to expire unused.
+func (t *Templates) RenderReminder(data InvitationData) (Message, error) {
+	return t.render("reminder", "Reminder: your invitation code is expiring", data)
+}
+
+func (t *Templates) render(name, subject string, data InvitationData) (Message, error) {
+	htmlBody, err := t.renderHTML(name+".html", data)
+	if err != nil {
+		return Message{}, fmt.Errorf("mailer: render %s.html: %w", name, err)
+	}
+
+	textBody, err := t.renderText(name+".txt", data)
+	if err != nil {
+		return Message{}, fmt.Errorf("mailer: render %s.txt: %w", name, err)
+	}
+
+	return Message{Subject: subject, HTMLBody: htmlBody, TextBody: textBody}, nil
+}
+
+func (t *Templates) renderHTML(file string, data InvitationData) (string, error) {
+	tmpl, err := htmltemplate.ParseFiles(filepath.Join(t.dir, file))
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (t *Templates) renderText(file string, data InvitationData) (string, error) {
+	tmpl, err := texttemplate.ParseFiles(filepath.Join(t.dir, file))
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
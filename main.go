@@ -1,23 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/redis/go-redis/v9"
 
-	"github.com/juju/ratelimit"
 	_ "github.com/lib/pq"
+
+	"github.com/pamodi/Lab5/mailer"
+	"github.com/pamodi/Lab5/oauth"
+	"github.com/pamodi/Lab5/passwords"
+	"github.com/pamodi/Lab5/ratelimiter"
+	"github.com/pamodi/Lab5/scheduler"
 )
 
 const (
@@ -28,8 +36,34 @@ const (
 	dbname   = ""
 )
 
-// JWT Key
-var jwtKey = []byte("")
+// JWT Key, set by SetupJWTKey before any other secret is read so
+// requireSecret's ALLOW_INSECURE_DEFAULTS fallback has something to fall
+// back to.
+var jwtKey []byte
+
+// SetupJWTKey establishes the HS256 signing/verification key shared by
+// GenerateAccessToken, AuthMiddleware and LogoutHandler. It must run
+// before any other Setup* call, since requireSecret's insecure-default
+// fallback reads jwtKey.
+func SetupJWTKey() {
+	jwtKey = requireSecret("JWT_SIGNING_KEY")
+}
+
+// requireSecret reads envVar as a cryptographic secret (HMAC pepper,
+// signing key, ...). Unlike ordinary config, an unset secret must not
+// silently fall back to some other subsystem's key: set
+// ALLOW_INSECURE_DEFAULTS=1 for local/dev runs that don't care, or set
+// envVar for anything else.
+func requireSecret(envVar string) []byte {
+	if v := os.Getenv(envVar); v != "" {
+		return []byte(v)
+	}
+	if os.Getenv("ALLOW_INSECURE_DEFAULTS") == "1" {
+		return jwtKey
+	}
+	log.Fatalf("%s must be set (or set ALLOW_INSECURE_DEFAULTS=1 for local development)", envVar)
+	return nil
+}
 
 // Struct to represent claims
 type Claims struct {
@@ -37,12 +71,6 @@ type Claims struct {
 	jwt.StandardClaims
 }
 
-// Struct to represent token
-type Token struct {
-	Token    string
-	ExpireAt time.Time
-}
-
 // Struct to represent invitation code
 type InvitationCode struct {
 	Code string `json:"code"`
@@ -60,31 +88,317 @@ type User struct {
 type Invitation struct {
 	ID    int
 	Email string
+	Code  string
 }
 
+// Per-route request quotas, overridable via
+// RATE_LIMIT_<ROUTE>_REQUESTS / RATE_LIMIT_<ROUTE>_WINDOW_SECONDS. The
+// login_email quota is enforced separately, keyed on the submitted
+// email rather than IP, to blunt credential stuffing across rotating
+// proxies.
 var (
-	// Define a map to store IP addresses and their corresponding rate limiters
-	ipLimiterMap = make(map[string]*ratelimit.Bucket)
-	// Mutex to synchronize access to the map
-	ipLimiterMapMutex sync.Mutex
+	defaultRouteQuotas = map[string]ratelimiter.Quota{
+		"token":    {Requests: 30, Window: time.Minute},
+		"login":    {Requests: 10, Window: time.Minute},
+		"register": {Requests: 5, Window: time.Minute},
+	}
+	defaultLoginEmailQuota = map[string]ratelimiter.Quota{
+		"login_email": {Requests: 5, Window: 15 * time.Minute},
+	}
 )
 
+// Email delivery: appMailer sends invitation and reminder emails,
+// emailTemplates renders them, and emailVerifier signs the links they
+// contain. appBaseURL is where those links point, e.g.
+// "https://example.com/verify".
+var (
+	appMailer      mailer.Mailer
+	emailTemplates *mailer.Templates
+	emailVerifier  *mailer.EmailVerifier
+	appBaseURL     string
+)
+
+// SetupMailer wires up the mailer based on environment configuration.
+// When SMTP_HOST is unset (e.g. in tests) it falls back to a NoopMailer
+// so the server still runs without a mail relay configured.
+func SetupMailer() {
+	cfg := mailer.ConfigFromEnv()
+	if cfg.Host == "" {
+		appMailer = mailer.NewNoopMailer()
+	} else {
+		appMailer = mailer.NewSMTPMailer(cfg)
+	}
+
+	emailTemplates = mailer.NewTemplates(cfg.TemplateDir)
+
+	verifierKey := requireSecret("EMAIL_VERIFIER_KEY")
+	// The verify link can't outlive the invitation code itself, or a
+	// user who clicks it after it expires gets a confusing "invalid
+	// code" from /register despite the link still looking valid.
+	emailVerifier = mailer.NewEmailVerifier(verifierKey, invitationTTL)
+
+	appBaseURL = os.Getenv("APP_BASE_URL")
+	if appBaseURL == "" {
+		appBaseURL = "http://localhost:8012"
+	}
+}
+
+// passwordHasher hashes and verifies user passwords; see SetupPasswords.
+var passwordHasher *passwords.Hasher
+
+// SetupPasswords builds the password hasher from the PASSWORD_PEPPER
+// environment variable (or KMS-backed secret in production).
+func SetupPasswords() {
+	passwordHasher = passwords.NewHasher(requireSecret("PASSWORD_PEPPER"))
+}
+
+// OAuth2 SSO: oauthProviders holds the configured third-party login
+// providers (Google/GitHub/Microsoft), oauthStates protects the
+// login->callback redirect against CSRF.
+var (
+	oauthProviders oauth.Providers
+	oauthStates    *oauth.StateSigner
+)
+
+// jobScheduler runs background jobs (invitation expiry/resend) claimed
+// from the durable jobs table; see SetupScheduler.
+var jobScheduler *scheduler.Scheduler
+
+// invitationTTL matches the INTERVAL '2 minutes' grace period already
+// used in the invitation-code queries below.
+const invitationTTL = 2 * time.Minute
+
+// SetupOAuth wires up OAuth2 providers configured via
+// OAUTH_<PROVIDER>_CLIENT_ID / _CLIENT_SECRET / _REDIRECT_URL.
+func SetupOAuth() {
+	oauthProviders = oauth.ProvidersFromEnv()
+
+	oauthStates = oauth.NewStateSigner(requireSecret("OAUTH_STATE_KEY"), 10*time.Minute)
+}
+
+// adminEmails authorizes /admin/* endpoints; see SetupAdmin.
+var adminEmails map[string]bool
+
+// SetupAdmin builds the /admin/* allowlist from the comma-separated
+// ADMIN_EMAILS environment variable. Left unset, no one is an admin and
+// /admin/* is simply unreachable, rather than open to any authenticated
+// user.
+func SetupAdmin() {
+	adminEmails = make(map[string]bool)
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			adminEmails[email] = true
+		}
+	}
+}
+
+// AdminMiddleware rejects requests from anyone not listed in
+// ADMIN_EMAILS. It must sit behind AuthMiddleware so the email it
+// checks is the token's verified one, not a client-supplied field.
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminEmails[verifiedEmail(r)] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// OAuthIdentityHandler resolves an external OAuth2 identity to a local
+// session. The provider's asserted email is proof of delivery, not
+// proof of ownership, so the first time a given provider/email pair is
+// seen — whether that's a brand new account or an existing
+// password-registered one — it's treated as linking a new login method,
+// gated on the same invitation code RegisterHandler requires. Only a
+// previously linked identity signs in silently.
+func OAuthIdentityHandler(db *sql.DB) func(oauth.Identity, string) (string, error) {
+	return func(identity oauth.Identity, invitationCode string) (string, error) {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email=$1)", identity.Email).Scan(&exists); err != nil {
+			return "", err
+		}
+
+		var linked bool
+		if exists {
+			err := db.QueryRow(
+				"SELECT EXISTS(SELECT 1 FROM oauth_identities WHERE provider=$1 AND email=$2)",
+				identity.Provider, identity.Email,
+			).Scan(&linked)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		switch {
+		case !exists:
+			if err := provisionOAuthUser(db, identity, invitationCode); err != nil {
+				return "", err
+			}
+		case !linked:
+			if err := linkOAuthIdentity(db, identity, invitationCode); err != nil {
+				return "", err
+			}
+		}
+
+		return GenerateJWTToken(identity.Email)
+	}
+}
+
+// provisionOAuthUser creates a local users row for a first-time OAuth2
+// sign-in with no matching account, subject to the same invitation-code
+// rules as RegisterHandler.
+func provisionOAuthUser(db *sql.DB, identity oauth.Identity, invitationCode string) error {
+	if err := consumeInvitationCode(db, identity.Email, invitationCode); err != nil {
+		return fmt.Errorf("signing up with %s: %w", identity.Provider, err)
+	}
+
+	// OAuth-provisioned accounts have no local password; password_hash
+	// stays empty so LoginHandler's password comparison can never match it.
+	if _, err := db.Exec("INSERT INTO users (email, password_hash) VALUES ($1, $2)", identity.Email, ""); err != nil {
+		return err
+	}
+
+	return recordOAuthLink(db, identity)
+}
+
+// linkOAuthIdentity is called the first time a provider/email pair
+// signs in against an already-registered account. The provider's
+// assertion alone isn't proof the caller controls that account, so
+// linking requires the same invitation-code proof a brand new signup
+// does, requested for that email via /invite just like registration.
+func linkOAuthIdentity(db *sql.DB, identity oauth.Identity, invitationCode string) error {
+	if err := consumeInvitationCode(db, identity.Email, invitationCode); err != nil {
+		return fmt.Errorf("linking %s to this account: %w", identity.Provider, err)
+	}
+
+	return recordOAuthLink(db, identity)
+}
+
+// consumeInvitationCode checks that code is a live, unused invitation
+// issued to email, then marks it used.
+func consumeInvitationCode(db *sql.DB, email, code string) error {
+	if code == "" {
+		return fmt.Errorf("an invitation code is required")
+	}
+
+	var isValidCode bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM invitation_codes WHERE code=$1 AND used=false AND email=$2 AND expires_at > NOW() - INTERVAL '2 minutes')", code, email).Scan(&isValidCode)
+	if err != nil {
+		return err
+	}
+	if !isValidCode {
+		return fmt.Errorf("invalid or expired invitation code")
+	}
+
+	if _, err := db.Exec("UPDATE invitation_codes SET used=true WHERE code=$1", code); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// recordOAuthLink marks identity's provider/email pair as linked so
+// future sign-ins don't need a fresh invitation code.
+func recordOAuthLink(db *sql.DB, identity oauth.Identity) error {
+	_, err := db.Exec(
+		"INSERT INTO oauth_identities (provider, email, linked_at) VALUES ($1, $2, NOW())",
+		identity.Provider, identity.Email,
+	)
+	return err
+}
+
+// invitationExpiresAfterText renders invitationTTL for the invitation
+// and reminder email copy, e.g. "in 2 minutes".
+func invitationExpiresAfterText() string {
+	minutes := int(invitationTTL / time.Minute)
+	if minutes == 1 {
+		return "in 1 minute"
+	}
+	return fmt.Sprintf("in %d minutes", minutes)
+}
+
+// SendInvitationEmail renders and sends the "here is your invitation
+// code" email, embedding a signed verify link rather than making the
+// user copy the code out of the API response.
+func SendInvitationEmail(email, code string) error {
+	verifyURL, err := emailVerifier.VerifyURL(appBaseURL+"/verify", email, code)
+	if err != nil {
+		return fmt.Errorf("building verify link: %w", err)
+	}
+
+	msg, err := emailTemplates.RenderInvitation(mailer.InvitationData{
+		Email:        email,
+		Code:         code,
+		VerifyURL:    verifyURL,
+		ExpiresAfter: invitationExpiresAfterText(),
+	})
+	if err != nil {
+		return fmt.Errorf("rendering invitation email: %w", err)
+	}
+
+	return appMailer.Send(email, msg)
+}
+
 func main() {
+	// Setup the JWT signing key first: requireSecret's insecure-default
+	// fallback (used by SetupPasswords/SetupMailer/SetupOAuth below)
+	// reads jwtKey.
+	SetupJWTKey()
+
 	// Setup database
 	db := SetupDatabase()
 	defer db.Close()
 
+	// Setup password hasher
+	SetupPasswords()
+
+	// Setup mailer
+	SetupMailer()
+
+	// Setup OAuth2 SSO providers
+	SetupOAuth()
+
+	// Setup the /admin/* allowlist
+	SetupAdmin()
+
+	// Seed the access-token revocation set from prior /logout and
+	// /sessions revokes so a restart doesn't resurrect revoked tokens.
+	if err := LoadRevokedJTIs(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// Setup rate limiters: routeLimiter enforces per-IP quotas on
+	// /token, /login and /register; loginEmailLimiter enforces a
+	// stricter, email-keyed quota on /login alone.
+	routeLimiter := SetupRateLimiter(ratelimiter.QuotasFromEnv(defaultRouteQuotas))
+	loginEmailLimiter := SetupRateLimiter(ratelimiter.QuotasFromEnv(defaultLoginEmailQuota))
+
+	// Setup the background job scheduler (invitation expiry/resend).
+	jobScheduler = SetupScheduler(db)
+
 	// Define API endpoints
-	http.HandleFunc("/token", GenerateTokenHandler())
+	http.HandleFunc("/token", RateLimitMiddleware(routeLimiter, "token", clientIPKey, GenerateTokenHandler(db)))
+	http.HandleFunc("/token/refresh", RefreshTokenHandler(db))
+	http.HandleFunc("/logout", LogoutHandler(db))
+	http.HandleFunc("/sessions", AuthMiddleware(SessionsHandler(db)))
 	http.HandleFunc("/invite", AuthMiddleware(GenerateInvitationCodeHandler(db)))
-	http.HandleFunc("/register", AuthMiddleware(RegisterHandler(db)))
-	http.HandleFunc("/login", RateLimitMiddleware(AuthMiddleware((LoginHandler(db)))))
+	http.HandleFunc("/verify", VerifyInvitationHandler(db))
+	http.HandleFunc("/register", RateLimitMiddleware(routeLimiter, "register", clientIPKey, AuthMiddleware(RegisterHandler(db))))
+	http.HandleFunc("/login", RateLimitMiddleware(routeLimiter, "login", clientIPKey,
+		RateLimitMiddleware(loginEmailLimiter, "login_email", loginEmailKey,
+			AuthMiddleware(LoginHandler(db)))))
+	http.HandleFunc("/oauth/", oauth.Handler(oauthProviders, oauthStates, OAuthIdentityHandler(db)))
+	http.HandleFunc("/admin/jobs", AuthMiddleware(AdminMiddleware(jobScheduler.AdminJobsHandler())))
+
+	// Background jobs must start before the blocking ListenAndServe
+	// call below, not after it — code placed after ListenAndServe never
+	// runs.
+	jobScheduler.Start()
 
 	fmt.Println("Server started on :8012")
 	// Start HTTP server
 	log.Fatal(http.ListenAndServe(":8012", nil))
-
-	ProcessResendCodes(db)
 }
 
 // Setup database
@@ -106,7 +420,7 @@ func SetupDatabase() *sql.DB {
 }
 
 // Generate token handler
-func GenerateTokenHandler() http.HandlerFunc {
+func GenerateTokenHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get user email from request header
 		value := r.PostFormValue("Email")
@@ -114,51 +428,56 @@ func GenerateTokenHandler() http.HandlerFunc {
 			http.Error(w, "Email header not found", http.StatusUnauthorized)
 			return
 		}
+		password := r.PostFormValue("Password")
+		if password == "" {
+			http.Error(w, "Password not found", http.StatusUnauthorized)
+			return
+		}
+
+		var userID int64
+		var passwordHsh string
+		if err := db.QueryRow("SELECT id, password_hash FROM users WHERE email = $1", value).Scan(&userID, &passwordHsh); err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		// This endpoint mints a refresh token good for refreshTokenTTL, so
+		// it needs the same proof of identity /login requires, not just a
+		// known email.
+		valid, err := passwordHasher.Verify(passwordHsh, password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			http.Error(w, "Invalid credential!", http.StatusUnauthorized)
+			return
+		}
 
-		// Generate JWT token
-		tokenString, err := GenerateJWTToken(value)
+		pair, err := IssueTokenPair(db, userID, value)
 		if err != nil {
 			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 			return
 		}
 
-		// Respond with JWT token
-		response := Token{Token: tokenString, ExpireAt: time.Now().Add(2 * time.Hour)}
+		// Respond with the access/refresh token pair
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		json.NewEncoder(w).Encode(pair)
 	}
 }
 
-// Generate JWT token
+// Generate JWT token. Kept around for callers (e.g. the OAuth2 identity
+// handler) that only need the bare access token string.
 func GenerateJWTToken(username string) (string, error) {
-	// Create JWT token claims
-	claims := jwt.MapClaims{
-		"email":  username,
-		"expiry": time.Now().Add(2 * time.Hour).Unix(), // Token expires in 2 minutes
-	}
-
-	// Create JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign token with secret key
-	tokenString, err := token.SignedString(jwtKey)
-	if err != nil {
-		fmt.Println(err)
-		return "", err
-	}
-
-	return tokenString, nil
+	tokenString, _, err := GenerateAccessToken(username)
+	return tokenString, err
 }
 
 // Authentication middleware
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		email := r.FormValue("email")
-		claims := jwt.MapClaims{
-			"email":  email,
-			"expiry": time.Now().Add(2 * time.Hour).Unix(),
-		}
+		claims := jwt.MapClaims{}
 
 		// Extract JWT token from Authorization header
 		tokenString := ExtractTokenFromHeader(r)
@@ -178,16 +497,40 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 		// Check if "expiry" claim exists and is valid
 		expClaim, ok := claims["expiry"].(float64)
-		if !ok || expClaim == 0 {
+		if !ok || expClaim == 0 || time.Now().Unix() > int64(expClaim) {
 			http.Error(w, "Expired token", http.StatusUnauthorized)
 			return
 		}
 
+		// Reject tokens revoked via /logout or /sessions before they
+		// naturally expired.
+		if jti, ok := claims["jti"].(string); ok && jti != "" && isJTIRevoked(jti) {
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		// Bind the token's own (verified) email to the request so
+		// handlers never have to trust a client-supplied "email" field
+		// for authorization decisions.
+		email, _ := claims["email"].(string)
+		ctx := context.WithValue(r.Context(), verifiedEmailContextKey, email)
+
 		// Proceed to the next handler
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
+type contextKey string
+
+const verifiedEmailContextKey contextKey = "verifiedEmail"
+
+// verifiedEmail returns the email AuthMiddleware verified for this
+// request, or "" if the request wasn't routed through AuthMiddleware.
+func verifiedEmail(r *http.Request) string {
+	email, _ := r.Context().Value(verifiedEmailContextKey).(string)
+	return email
+}
+
 // Function to extract token from header
 func ExtractTokenFromHeader(r *http.Request) string {
 	authHeader := r.Header.Get("Authorization")
@@ -214,7 +557,6 @@ func GenerateInvitationCodeHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 		code := base64.URLEncoding.EncodeToString(codeBytes)
-		fmt.Println(code)
 		// Insert the code into the database
 		_, err = db.Exec("INSERT INTO invitation_codes (code, email, used) VALUES ($1, $2, false)", code, email)
 		if err != nil {
@@ -222,6 +564,19 @@ func GenerateInvitationCodeHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Email the code to the user as a signed verify link rather than
+		// making them copy it out of this response.
+		if err := SendInvitationEmail(email, code); err != nil {
+			fmt.Println("Error sending invitation email:", err)
+		}
+
+		// Schedule a durable follow-up: if the code is still unused once
+		// it expires, send a reminder instead of leaving it to a
+		// best-effort sleep loop.
+		if err := enqueueExpireInvitation(email, code, time.Now().Add(invitationTTL)); err != nil {
+			fmt.Println("Error scheduling invitation expiry job:", err)
+		}
+
 		// Return the generated code
 		invitationCode := InvitationCode{Code: code}
 		json.NewEncoder(w).Encode(invitationCode)
@@ -229,6 +584,39 @@ func GenerateInvitationCodeHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// VerifyInvitationHandler redeems the signed link from an invitation
+// email. It doesn't register the user itself, it just confirms the
+// link is genuine and hands back the email/code pair so the client can
+// show a "set your password" form that posts to /register.
+func VerifyInvitationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			http.Error(w, "Missing token", http.StatusBadRequest)
+			return
+		}
+
+		email, code, err := emailVerifier.Verify(token)
+		if err != nil {
+			http.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+			return
+		}
+
+		var codeExists bool
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM invitation_codes WHERE code=$1 AND email=$2 AND used=false)", code, email).Scan(&codeExists)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !codeExists {
+			http.Error(w, "Invitation code no longer valid", http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(User{Email: email, Code: code})
+	}
+}
+
 // Register handler
 func RegisterHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -277,7 +665,7 @@ func RegisterHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Hash the password
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		hashedPassword, err := passwordHasher.Hash(user.Password)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -328,8 +716,12 @@ func LoginHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Compare passwords
-		err = bcrypt.CompareHashAndPassword([]byte(passwordHsh), []byte(user.Password))
+		valid, err := passwordHasher.Verify(passwordHsh, user.Password)
 		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !valid {
 			http.Error(w, "Invalid credential!", http.StatusMethodNotAllowed)
 			return
 		}
@@ -337,21 +729,30 @@ func LoginHandler(db *sql.DB) http.HandlerFunc {
 		var user_id int64
 		_ = db.QueryRow("SELECT id FROM users WHERE email = $1", user.Email).Scan(&user_id)
 
-		// Insert user session into the database
-		_, err = db.Exec("INSERT INTO sessions (user_id, token) VALUES ($1, $2)", user_id, tokenString)
+		// Migrate legacy/weaker-policy hashes opportunistically now that
+		// the password has been verified, rather than in a big-bang
+		// rewrite of the users table.
+		if passwordHasher.NeedsRehash(passwordHsh) {
+			if rehashed, err := passwordHasher.Hash(user.Password); err == nil {
+				db.Exec("UPDATE users SET password_hash=$1 WHERE id=$2", rehashed, user_id)
+			}
+		}
+
+		pair, err := IssueTokenPair(db, user_id, user.Email)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "Logged in successfully!\n")
+		json.NewEncoder(w).Encode(pair)
 	}
 }
 
 // Function to query the database for expired invitation codes
 func GetExpiredInvitations(db *sql.DB) ([]Invitation, error) {
-	rows, err := db.Query("SELECT id, email FROM invitation_codes WHERE used = false AND expires_at < NOW() - INTERVAL '2 minutes'")
+	rows, err := db.Query("SELECT id, email, code FROM invitation_codes WHERE used = false AND reminded_at IS NULL AND expires_at < NOW() - INTERVAL '2 minutes'")
 	if err != nil {
 		return nil, err
 	}
@@ -360,7 +761,7 @@ func GetExpiredInvitations(db *sql.DB) ([]Invitation, error) {
 	var expiredInvitations []Invitation
 	for rows.Next() {
 		var invitation Invitation
-		if err := rows.Scan(&invitation.ID, &invitation.Email); err != nil {
+		if err := rows.Scan(&invitation.ID, &invitation.Email, &invitation.Code); err != nil {
 			return nil, err
 		}
 		expiredInvitations = append(expiredInvitations, invitation)
@@ -369,54 +770,53 @@ func GetExpiredInvitations(db *sql.DB) ([]Invitation, error) {
 	return expiredInvitations, nil
 }
 
-// Schedule a background task to run periodically
-func ProcessResendCodes(db *sql.DB) {
-
-	for {
-		// Query database for expired invitation codes
-		expiredInvitations, err := GetExpiredInvitations(db)
-		if err != nil {
-			fmt.Println("Error querying expired invitations:", err)
-			continue
-		}
-
-		// Resend invitation codes or send reminders to users
-		for _, invitation := range expiredInvitations {
-			err := ResendInvitation(invitation)
-			if err != nil {
-				fmt.Println("Error resending invitation:", err)
-			}
-		}
+// Function to resend invitation or send reminder to user
+func ResendInvitation(invitation Invitation) error {
+	verifyURL, err := emailVerifier.VerifyURL(appBaseURL+"/verify", invitation.Email, invitation.Code)
+	if err != nil {
+		return fmt.Errorf("building verify link: %w", err)
+	}
 
-		// Wait for some time before running the background task again
-		time.Sleep(2 * time.Hour)
+	msg, err := emailTemplates.RenderReminder(mailer.InvitationData{
+		Email:        invitation.Email,
+		Code:         invitation.Code,
+		VerifyURL:    verifyURL,
+		ExpiresAfter: invitationExpiresAfterText(),
+	})
+	if err != nil {
+		return fmt.Errorf("rendering reminder email: %w", err)
 	}
+
+	return appMailer.Send(invitation.Email, msg)
 }
 
-// Function to resend invitation or send reminder to user
-func ResendInvitation(invitation Invitation) error {
-	// TODO: Send new invitation code to the user's email
-	fmt.Printf("Resending invitation to %s\n", invitation.Email)
-	return nil
+// SetupRateLimiter builds the Limiter used by RateLimitMiddleware. With
+// REDIS_ADDR set it uses a Redis-backed sliding-window counter shared
+// across replicas; otherwise it falls back to an in-process token
+// bucket, which is fine for a single instance but won't coordinate
+// quota across a fleet.
+func SetupRateLimiter(quotas map[string]ratelimiter.Quota) ratelimiter.Limiter {
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		client := redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: os.Getenv("REDIS_PASSWORD"),
+		})
+		return ratelimiter.NewRedisLimiter(client, quotas)
+	}
+	return ratelimiter.NewBucketLimiter(quotas, 10*time.Minute, time.Minute)
 }
 
-// Rate limit middleware
-func RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// RateLimitMiddleware rejects requests once limiter's quota for route
+// is exhausted for the key keyFunc extracts from the request (e.g. the
+// client IP or the submitted email).
+func RateLimitMiddleware(limiter ratelimiter.Limiter, route string, keyFunc func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Get the IP address of the client
-		ip := r.RemoteAddr
-
-		ipLimiterMapMutex.Lock()
-		limiter, exists := ipLimiterMap[ip]
-		if !exists {
-			// Create a new rate limiter for the IP address
-			limiter = ratelimit.NewBucketWithRate(1, 1)
-			ipLimiterMap[ip] = limiter
+		allowed, err := limiter.Allow(route, keyFunc(r))
+		if err != nil {
+			http.Error(w, "Rate limiter unavailable", http.StatusServiceUnavailable)
+			return
 		}
-		ipLimiterMapMutex.Unlock()
-
-		// Take a token from the rate limiter
-		if limiter.TakeAvailable(1) == 0 {
+		if !allowed {
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
@@ -424,3 +824,26 @@ func RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		next.ServeHTTP(w, r)
 	}
 }
+
+// clientIPKey keys a rate limit bucket on the client's remote address.
+func clientIPKey(r *http.Request) string {
+	return r.RemoteAddr
+}
+
+// loginEmailKey keys a rate limit bucket on the email in the login
+// request body, falling back to the client IP if it can't be read.
+// LoginHandler also needs that body, so the bytes read here are
+// restored onto the request before returning.
+func loginEmailKey(r *http.Request) string {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return clientIPKey(r)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var user User
+	if err := json.Unmarshal(body, &user); err != nil || user.Email == "" {
+		return clientIPKey(r)
+	}
+	return user.Email
+}
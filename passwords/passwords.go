@@ -0,0 +1,136 @@
+// Package passwords hashes and verifies user passwords. Argon2id is
+// the current policy; bcrypt hashes written under the previous policy
+// still verify, and callers are expected to rehash once NeedsRehash
+// says so, migrating accounts opportunistically on login rather than
+// in one big-bang rewrite.
+package passwords
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Current Argon2id policy. Hashes written with weaker parameters are
+// flagged by NeedsRehash so they get upgraded on next successful login.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 2
+	saltLen       = 16
+	keyLen        = 32
+)
+
+// Hasher hashes and verifies passwords. Every password is HMAC'd with a
+// server-wide pepper before it reaches argon2/bcrypt, so a leaked hash
+// database alone isn't enough to brute-force accounts.
+type Hasher struct {
+	pepper []byte
+}
+
+// NewHasher builds a Hasher that peppers passwords with pepper, which
+// should come from an environment variable or KMS, never the database
+// the hashes themselves live in.
+func NewHasher(pepper []byte) *Hasher {
+	return &Hasher{pepper: pepper}
+}
+
+func (h *Hasher) peppered(password string) []byte {
+	mac := hmac.New(sha256.New, h.pepper)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// Hash produces a PHC-style Argon2id hash:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func (h *Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey(h.peppered(password), salt, argon2Time, argon2Memory, argon2Threads, keyLen)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify reports whether password matches encoded, which may be either
+// a current Argon2id hash or a legacy bcrypt hash.
+func (h *Hasher) Verify(encoded, password string) (bool, error) {
+	if strings.HasPrefix(encoded, "$argon2id$") {
+		return h.verifyArgon2(encoded, password)
+	}
+
+	// Legacy bcrypt hashes predate the pepper. Any comparison failure
+	// (mismatch, or malformed/empty hash such as an OAuth-only account)
+	// is just an invalid credential, not an operational error.
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil, nil
+}
+
+// NeedsRehash reports whether encoded was produced under a weaker
+// policy than the current one (any bcrypt hash, or an Argon2id hash
+// with params below the current policy) and should be rehashed now
+// that it has been verified.
+func (h *Hasher) NeedsRehash(encoded string) bool {
+	if !strings.HasPrefix(encoded, "$argon2id$") {
+		return true
+	}
+
+	memory, time, threads, _, _, err := parseArgon2(encoded)
+	if err != nil {
+		return true
+	}
+	return memory < argon2Memory || time < argon2Time || threads < argon2Threads
+}
+
+func (h *Hasher) verifyArgon2(encoded, password string) (bool, error) {
+	memory, time, threads, salt, want, err := parseArgon2(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	got := argon2.IDKey(h.peppered(password), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+func parseArgon2(encoded string) (memory, time uint32, threads uint8, salt, hash []byte, err error) {
+	// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return 0, 0, 0, nil, nil, fmt.Errorf("passwords: malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return 0, 0, 0, nil, nil, fmt.Errorf("passwords: malformed argon2id version: %w", err)
+	}
+
+	var m, t, p int
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+		return 0, 0, 0, nil, nil, fmt.Errorf("passwords: malformed argon2id params: %w", err)
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return 0, 0, 0, nil, nil, fmt.Errorf("passwords: malformed argon2id salt: %w", err)
+	}
+
+	hash, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return 0, 0, 0, nil, nil, fmt.Errorf("passwords: malformed argon2id hash: %w", err)
+	}
+
+	return uint32(m), uint32(t), uint8(p), salt, hash, nil
+}
@@ -0,0 +1,94 @@
+package ratelimiter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// BucketLimiter is a single-process Limiter built on juju/ratelimit
+// token buckets, one per (route, key). Buckets idle for longer than
+// idleTTL are evicted by a background sweep so a long-running process
+// doesn't accumulate one bucket per churned IP forever.
+type BucketLimiter struct {
+	quotas map[string]Quota
+
+	mu      sync.Mutex
+	buckets map[string]*bucketEntry
+
+	idleTTL time.Duration
+	stop    chan struct{}
+}
+
+type bucketEntry struct {
+	bucket     *ratelimit.Bucket
+	lastAccess time.Time
+}
+
+// NewBucketLimiter builds a BucketLimiter with the given per-route
+// quotas. Buckets unused for idleTTL are evicted every sweepInterval.
+func NewBucketLimiter(quotas map[string]Quota, idleTTL, sweepInterval time.Duration) *BucketLimiter {
+	l := &BucketLimiter{
+		quotas:  quotas,
+		buckets: make(map[string]*bucketEntry),
+		idleTTL: idleTTL,
+		stop:    make(chan struct{}),
+	}
+	go l.sweepLoop(sweepInterval)
+	return l
+}
+
+// Allow reports whether key may make another request against route.
+// Routes with no configured quota are always allowed.
+func (l *BucketLimiter) Allow(route, key string) (bool, error) {
+	quota, ok := l.quotas[route]
+	if !ok {
+		return true, nil
+	}
+
+	bucketKey := route + ":" + key
+
+	l.mu.Lock()
+	e, ok := l.buckets[bucketKey]
+	if !ok {
+		fillRate := float64(quota.Requests) / quota.Window.Seconds()
+		e = &bucketEntry{bucket: ratelimit.NewBucketWithRate(fillRate, int64(quota.Requests))}
+		l.buckets[bucketKey] = e
+	}
+	e.lastAccess = time.Now()
+	bucket := e.bucket
+	l.mu.Unlock()
+
+	return bucket.TakeAvailable(1) == 1, nil
+}
+
+// Close stops the background eviction sweep.
+func (l *BucketLimiter) Close() {
+	close(l.stop)
+}
+
+func (l *BucketLimiter) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.sweep()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *BucketLimiter) sweep() {
+	cutoff := time.Now().Add(-l.idleTTL)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, e := range l.buckets {
+		if e.lastAccess.Before(cutoff) {
+			delete(l.buckets, key)
+		}
+	}
+}
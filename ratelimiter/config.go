@@ -0,0 +1,37 @@
+package ratelimiter
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuotasFromEnv builds per-route quotas from
+// RATE_LIMIT_<ROUTE>_REQUESTS / RATE_LIMIT_<ROUTE>_WINDOW_SECONDS,
+// falling back to the supplied default for any route or field left
+// unset.
+func QuotasFromEnv(defaults map[string]Quota) map[string]Quota {
+	quotas := make(map[string]Quota, len(defaults))
+	for route, def := range defaults {
+		quotas[route] = quotaFromEnv(route, def)
+	}
+	return quotas
+}
+
+func quotaFromEnv(route string, def Quota) Quota {
+	prefix := "RATE_LIMIT_" + strings.ToUpper(route) + "_"
+
+	quota := def
+	if v := os.Getenv(prefix + "REQUESTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			quota.Requests = n
+		}
+	}
+	if v := os.Getenv(prefix + "WINDOW_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			quota.Window = time.Duration(n) * time.Second
+		}
+	}
+	return quota
+}
@@ -0,0 +1,21 @@
+// Package ratelimiter provides pluggable, per-route request rate
+// limiting. BucketLimiter works within a single process; RedisLimiter
+// shares quota across replicas. Both implement Limiter, so callers can
+// swap one for the other without touching the middleware that uses
+// them.
+package ratelimiter
+
+import "time"
+
+// Limiter decides whether a request identified by key (e.g. a client
+// IP or an email address) is allowed under the quota configured for
+// route.
+type Limiter interface {
+	Allow(route, key string) (bool, error)
+}
+
+// Quota is the requests-per-window budget for a single route.
+type Quota struct {
+	Requests int
+	Window   time.Duration
+}
@@ -0,0 +1,65 @@
+package ratelimiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisLimiter is a Limiter backed by a Redis counter per
+// (route, key, window), so quota is shared across replicas instead of
+// tracked per-process. It's a weighted sliding window: Allow counts the
+// current window's "rl:{route}:{key}:{window}" INCR in full and the
+// previous window's count weighted by how much of it still overlaps a
+// window ending now, so a burst can't pass 2x quota by straddling a
+// window boundary the way a plain fixed-window counter would.
+type RedisLimiter struct {
+	client *redis.Client
+	quotas map[string]Quota
+}
+
+// NewRedisLimiter builds a RedisLimiter backed by client, with the
+// given per-route quotas.
+func NewRedisLimiter(client *redis.Client, quotas map[string]Quota) *RedisLimiter {
+	return &RedisLimiter{client: client, quotas: quotas}
+}
+
+// Allow reports whether key may make another request against route.
+// Routes with no configured quota are always allowed.
+func (l *RedisLimiter) Allow(route, key string) (bool, error) {
+	quota, ok := l.quotas[route]
+	if !ok {
+		return true, nil
+	}
+
+	ctx := context.Background()
+	windowSeconds := int64(quota.Window.Seconds())
+	now := time.Now().Unix()
+	window := now / windowSeconds
+	elapsed := now % windowSeconds
+
+	currKey := fmt.Sprintf("rl:%s:%s:%d", route, key, window)
+	prevKey := fmt.Sprintf("rl:%s:%s:%d", route, key, window-1)
+
+	count, err := l.client.Incr(ctx, currKey).Result()
+	if err != nil {
+		return false, fmt.Errorf("ratelimiter: redis incr: %w", err)
+	}
+	if count == 1 {
+		// Keep the key alive for one extra window past its own so it's
+		// still readable as "previous" once the next window starts.
+		l.client.Expire(ctx, currKey, 2*quota.Window)
+	}
+
+	prevCount, err := l.client.Get(ctx, prevKey).Int64()
+	if err != nil && err != redis.Nil {
+		return false, fmt.Errorf("ratelimiter: redis get: %w", err)
+	}
+
+	overlap := float64(windowSeconds-elapsed) / float64(windowSeconds)
+	estimated := float64(prevCount)*overlap + float64(count)
+
+	return estimated <= float64(quota.Requests), nil
+}
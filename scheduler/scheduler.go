@@ -0,0 +1,233 @@
+// Package scheduler runs background jobs claimed from a durable jobs
+// table instead of an in-process sleep loop, so scheduled work survives
+// restarts and is safe to run across multiple replicas.
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// defaultMaxAttempts is used for ad-hoc enqueues; callers that need a
+// different retry budget can enqueue the row themselves.
+const defaultMaxAttempts = 5
+
+// Handler processes a single claimed job. Handlers must be idempotent:
+// a crash between claiming a job and marking it done means it can be
+// picked up and run again.
+type Handler func(ctx context.Context, db *sql.DB, payload string) error
+
+// Job is a single row claimed from the jobs table.
+type Job struct {
+	ID          int64
+	Kind        string
+	Payload     string
+	Attempts    int
+	MaxAttempts int
+}
+
+// Scheduler claims and runs jobs from the jobs table. Claiming uses
+// SELECT ... FOR UPDATE SKIP LOCKED so multiple replicas can poll the
+// same table without two of them claiming the same row.
+type Scheduler struct {
+	db           *sql.DB
+	handlers     map[string]Handler
+	pollInterval time.Duration
+	cron         *cron.Cron
+	stop         chan struct{}
+}
+
+// New builds a Scheduler that polls the jobs table every pollInterval.
+func New(db *sql.DB, pollInterval time.Duration) *Scheduler {
+	return &Scheduler{
+		db:           db,
+		handlers:     make(map[string]Handler),
+		pollInterval: pollInterval,
+		cron:         cron.New(),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Register associates kind with the handler that processes it.
+func (s *Scheduler) Register(kind string, h Handler) {
+	s.handlers[kind] = h
+}
+
+// Enqueue inserts an ad-hoc job of kind to run at runAt.
+func (s *Scheduler) Enqueue(kind, payload string, runAt time.Time) error {
+	_, err := s.db.Exec(
+		"INSERT INTO jobs (kind, payload, run_at, attempts, max_attempts) VALUES ($1, $2, $3, 0, $4)",
+		kind, payload, runAt, defaultMaxAttempts,
+	)
+	return err
+}
+
+// AddCron enqueues a job of kind (with payload) every time spec fires,
+// using the standard five-field cron syntax.
+func (s *Scheduler) AddCron(spec, kind, payload string) error {
+	_, err := s.cron.AddFunc(spec, func() {
+		if err := s.Enqueue(kind, payload, time.Now()); err != nil {
+			log.Println("scheduler: failed to enqueue cron job:", err)
+		}
+	})
+	return err
+}
+
+// Start runs the cron scheduler and the jobs-table poll loop as
+// background goroutines. Call it before http.ListenAndServe, not after
+// — code placed after a blocking ListenAndServe call never runs.
+func (s *Scheduler) Start() {
+	s.cron.Start()
+	go s.pollLoop()
+}
+
+// Stop halts the cron scheduler and the poll loop.
+func (s *Scheduler) Stop() {
+	s.cron.Stop()
+	close(s.stop)
+}
+
+func (s *Scheduler) pollLoop() {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.runDue()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// runDue claims and runs every due job, one at a time, until the queue
+// is empty.
+func (s *Scheduler) runDue() {
+	for {
+		job, ok, err := s.claim()
+		if err != nil {
+			log.Println("scheduler: failed to claim job:", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		s.run(job)
+	}
+}
+
+func (s *Scheduler) claim() (Job, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Job{}, false, err
+	}
+	defer tx.Rollback()
+
+	var job Job
+	err = tx.QueryRow(`
+		SELECT id, kind, payload, attempts, max_attempts FROM jobs
+		WHERE run_at <= NOW() AND completed_at IS NULL AND attempts < max_attempts
+		  AND (locked_at IS NULL OR locked_at < NOW() - INTERVAL '1 minute')
+		ORDER BY run_at
+		FOR UPDATE SKIP LOCKED
+		LIMIT 1`,
+	).Scan(&job.ID, &job.Kind, &job.Payload, &job.Attempts, &job.MaxAttempts)
+	if err == sql.ErrNoRows {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+
+	if _, err := tx.Exec("UPDATE jobs SET attempts = attempts + 1, locked_at = NOW() WHERE id = $1", job.ID); err != nil {
+		return Job{}, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Job{}, false, err
+	}
+
+	job.Attempts++
+	return job, true, nil
+}
+
+func (s *Scheduler) run(job Job) {
+	handler, ok := s.handlers[job.Kind]
+	if !ok {
+		log.Printf("scheduler: no handler registered for job kind %q\n", job.Kind)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := handler(ctx, s.db, job.Payload)
+	if err == nil {
+		s.db.Exec("UPDATE jobs SET completed_at = NOW() WHERE id = $1", job.ID)
+		return
+	}
+	log.Printf("scheduler: job %d (%s) failed (attempt %d/%d): %v\n", job.ID, job.Kind, job.Attempts, job.MaxAttempts, err)
+
+	if job.Attempts >= job.MaxAttempts {
+		s.db.Exec("UPDATE jobs SET failed_at = NOW() WHERE id = $1", job.ID)
+		return
+	}
+
+	// Exponential backoff before the next attempt.
+	backoffSeconds := int64(1) << uint(job.Attempts)
+	s.db.Exec("UPDATE jobs SET run_at = NOW() + ($1 || ' seconds')::interval, locked_at = NULL WHERE id = $2", backoffSeconds, job.ID)
+}
+
+// jobView is the JSON shape /admin/jobs returns.
+type jobView struct {
+	ID          int64      `json:"id"`
+	Kind        string     `json:"kind"`
+	Payload     string     `json:"payload"`
+	RunAt       time.Time  `json:"run_at"`
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	FailedAt    *time.Time `json:"failed_at,omitempty"`
+}
+
+// AdminJobsHandler serves /admin/jobs: the most recent jobs, pending,
+// completed or failed, newest first.
+func (s *Scheduler) AdminJobsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := s.db.Query(`
+			SELECT id, kind, payload, run_at, attempts, max_attempts, completed_at, failed_at
+			FROM jobs ORDER BY id DESC LIMIT 200`,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		jobs := []jobView{}
+		for rows.Next() {
+			var j jobView
+			var completedAt, failedAt sql.NullTime
+			if err := rows.Scan(&j.ID, &j.Kind, &j.Payload, &j.RunAt, &j.Attempts, &j.MaxAttempts, &completedAt, &failedAt); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if completedAt.Valid {
+				j.CompletedAt = &completedAt.Time
+			}
+			if failedAt.Valid {
+				j.FailedAt = &failedAt.Time
+			}
+			jobs = append(jobs, j)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Access tokens are short-lived JWTs; refresh tokens are long-lived
+// opaque values exchanged for a new pair via /token/refresh.
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// TokenPair is the access/refresh token response the password login
+// paths (/login, /token) and /token/refresh return. The OAuth2 callback
+// does not return one: it responds with a bare access token and issues
+// no refresh token or sessions row.
+type TokenPair struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpireAt     time.Time `json:"expire_at"`
+}
+
+// revokedJTIs is the in-memory set AuthMiddleware consults to reject
+// access tokens revoked before their natural expiry (e.g. via /logout).
+// It's seeded from the revoked_tokens table at startup and kept in
+// sync as revocations happen, so the hot auth path doesn't need a DB
+// round-trip per request.
+var (
+	revokedJTIs      = make(map[string]time.Time) // jti -> access token expiry
+	revokedJTIsMutex sync.Mutex
+)
+
+// LoadRevokedJTIs seeds the in-memory revocation set from the
+// revoked_tokens table and starts the background sweep that evicts
+// entries once their access token would have expired naturally anyway,
+// so a long-running process doesn't accumulate one entry per revocation
+// forever. Rows whose access token has already expired are skipped on
+// load since AuthMiddleware would reject them on expiry alone.
+func LoadRevokedJTIs(db *sql.DB) error {
+	rows, err := db.Query("SELECT jti, expires_at FROM revoked_tokens WHERE expires_at > NOW()")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	revokedJTIsMutex.Lock()
+	for rows.Next() {
+		var jti string
+		var expiresAt time.Time
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			revokedJTIsMutex.Unlock()
+			return err
+		}
+		revokedJTIs[jti] = expiresAt
+	}
+	revokedJTIsMutex.Unlock()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	go sweepRevokedJTIsLoop(revokedJTIsSweepInterval)
+	return nil
+}
+
+// revokedJTIsSweepInterval is how often sweepRevokedJTIsLoop evicts
+// expired entries from revokedJTIs.
+const revokedJTIsSweepInterval = time.Hour
+
+func sweepRevokedJTIsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweepRevokedJTIs()
+	}
+}
+
+func sweepRevokedJTIs() {
+	now := time.Now()
+
+	revokedJTIsMutex.Lock()
+	defer revokedJTIsMutex.Unlock()
+	for jti, expiresAt := range revokedJTIs {
+		if expiresAt.Before(now) {
+			delete(revokedJTIs, jti)
+		}
+	}
+}
+
+// RevokeAccessToken persists jti as revoked, so other replicas pick it
+// up on their next restart, and adds it to the local revocation set
+// immediately.
+func RevokeAccessToken(db *sql.DB, jti string, expiresAt time.Time) error {
+	_, err := db.Exec("INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING", jti, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	revokedJTIsMutex.Lock()
+	revokedJTIs[jti] = expiresAt
+	revokedJTIsMutex.Unlock()
+	return nil
+}
+
+func isJTIRevoked(jti string) bool {
+	revokedJTIsMutex.Lock()
+	defer revokedJTIsMutex.Unlock()
+	_, revoked := revokedJTIs[jti]
+	return revoked
+}
+
+// GenerateAccessToken mints a short-lived JWT for email, identified by
+// a random jti so it can be individually revoked before it expires.
+func GenerateAccessToken(email string) (tokenString, jti string, err error) {
+	jtiBytes := make([]byte, 16)
+	if _, err := rand.Read(jtiBytes); err != nil {
+		return "", "", err
+	}
+	jti = base64.RawURLEncoding.EncodeToString(jtiBytes)
+
+	claims := jwt.MapClaims{
+		"email":  email,
+		"jti":    jti,
+		"expiry": time.Now().Add(accessTokenTTL).Unix(),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err = token.SignedString(jwtKey)
+	if err != nil {
+		return "", "", err
+	}
+	return tokenString, jti, nil
+}
+
+// generateRefreshToken returns a fresh opaque refresh token and the jti
+// it's stored under. Only the jti (a hash of the token) is persisted,
+// so a database read never discloses a usable token.
+func generateRefreshToken() (token, jti string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(secret)
+	return token, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueRefreshToken mints a new refresh token for userID and records it
+// in the refresh_tokens table.
+func IssueRefreshToken(db *sql.DB, userID int64) (token, jti string, err error) {
+	token, jti, err = generateRefreshToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO refresh_tokens (jti, user_id, issued_at, expires_at) VALUES ($1, $2, NOW(), $3)",
+		jti, userID, time.Now().Add(refreshTokenTTL),
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, jti, nil
+}
+
+// IssueTokenPair mints a fresh access token and a fresh refresh token
+// for userID/email and records the session linking them.
+func IssueTokenPair(db *sql.DB, userID int64, email string) (TokenPair, error) {
+	accessToken, jti, err := GenerateAccessToken(email)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refreshToken, refreshJTI, err := IssueRefreshToken(db, userID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	if _, err := db.Exec("INSERT INTO sessions (user_id, jti, refresh_jti) VALUES ($1, $2, $3)", userID, jti, refreshJTI); err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpireAt:     time.Now().Add(accessTokenTTL),
+	}, nil
+}
+
+// RotateRefreshToken exchanges tokenString for a new refresh token.
+//
+// If tokenString has already been rotated or explicitly revoked,
+// presenting it again is treated as theft: every refresh token for the
+// owning user is revoked, killing the whole session chain (classic
+// refresh-token reuse detection).
+func RotateRefreshToken(db *sql.DB, tokenString string) (userID int64, email, newToken, newJTI string, err error) {
+	jti := hashRefreshToken(tokenString)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", "", "", err
+	}
+	defer tx.Rollback()
+
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	err = tx.QueryRow("SELECT user_id, expires_at, revoked_at FROM refresh_tokens WHERE jti=$1 FOR UPDATE", jti).Scan(&userID, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return 0, "", "", "", fmt.Errorf("invalid refresh token")
+	}
+	if err != nil {
+		return 0, "", "", "", err
+	}
+
+	if revokedAt.Valid {
+		// FOR UPDATE serializes concurrent rotations of the same jti, so
+		// a revoked row here can only mean the token was already rotated
+		// (or reused) by a completed call, not a request racing us.
+		_ = RevokeAllRefreshTokens(db, userID)
+		return 0, "", "", "", fmt.Errorf("refresh token reuse detected, session revoked")
+	}
+
+	if time.Now().After(expiresAt) {
+		return 0, "", "", "", fmt.Errorf("refresh token expired")
+	}
+
+	if err := tx.QueryRow("SELECT email FROM users WHERE id=$1", userID).Scan(&email); err != nil {
+		return 0, "", "", "", err
+	}
+
+	newToken, newJTI, err = generateRefreshToken()
+	if err != nil {
+		return 0, "", "", "", err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO refresh_tokens (jti, user_id, issued_at, expires_at) VALUES ($1, $2, NOW(), $3)",
+		newJTI, userID, time.Now().Add(refreshTokenTTL),
+	); err != nil {
+		return 0, "", "", "", err
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at=NOW(), replaced_by=$1 WHERE jti=$2 AND revoked_at IS NULL", newJTI, jti); err != nil {
+		return 0, "", "", "", err
+	}
+
+	// Close out the session this refresh token belonged to, so GET
+	// /sessions doesn't accumulate a phantom "active" row every time a
+	// single continuous login refreshes.
+	if _, err := tx.Exec("UPDATE sessions SET revoked_at=NOW() WHERE refresh_jti=$1", jti); err != nil {
+		return 0, "", "", "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, "", "", "", err
+	}
+
+	return userID, email, newToken, newJTI, nil
+}
+
+// RevokeAllRefreshTokens revokes every outstanding refresh token for
+// userID, e.g. after reuse detection or a "log out everywhere" request.
+func RevokeAllRefreshTokens(db *sql.DB, userID int64) error {
+	_, err := db.Exec("UPDATE refresh_tokens SET revoked_at=NOW() WHERE user_id=$1 AND revoked_at IS NULL", userID)
+	return err
+}
+
+// RefreshTokenHandler rotates a refresh token into a fresh access/refresh
+// pair.
+func RefreshTokenHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method is allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.RefreshToken == "" {
+			http.Error(w, "Missing refresh token", http.StatusBadRequest)
+			return
+		}
+
+		userID, email, newRefreshToken, newRefreshJTI, err := RotateRefreshToken(db, req.RefreshToken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		accessToken, jti, err := GenerateAccessToken(email)
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := db.Exec("INSERT INTO sessions (user_id, jti, refresh_jti) VALUES ($1, $2, $3)", userID, jti, newRefreshJTI); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TokenPair{
+			Token:        accessToken,
+			RefreshToken: newRefreshToken,
+			ExpireAt:     time.Now().Add(accessTokenTTL),
+		})
+	}
+}
+
+// LogoutHandler revokes the caller's current session: the access
+// token's jti is blacklisted immediately, and its refresh token is
+// marked revoked so it can't be used to mint new access tokens.
+func LogoutHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString := ExtractTokenFromHeader(r)
+		if tokenString == "" {
+			http.Error(w, "Authorization header not found", http.StatusUnauthorized)
+			return
+		}
+
+		claims := jwt.MapClaims{}
+		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			return jwtKey, nil
+		})
+		if err != nil || !token.Valid {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		jti, _ := claims["jti"].(string)
+		if jti == "" {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		expiresAt := time.Now().Add(accessTokenTTL)
+		if expClaim, ok := claims["expiry"].(float64); ok {
+			expiresAt = time.Unix(int64(expClaim), 0)
+		}
+		if err := RevokeAccessToken(db, jti, expiresAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var refreshJTI sql.NullString
+		_ = db.QueryRow("SELECT refresh_jti FROM sessions WHERE jti=$1", jti).Scan(&refreshJTI)
+		if refreshJTI.Valid {
+			db.Exec("UPDATE refresh_tokens SET revoked_at=NOW() WHERE jti=$1", refreshJTI.String)
+		}
+		db.Exec("UPDATE sessions SET revoked_at=NOW() WHERE jti=$1", jti)
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "Logged out")
+	}
+}
+
+// Session is a single entry returned by GET /sessions.
+type Session struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SessionsHandler lists the caller's active sessions on GET and revokes
+// one by id on DELETE (DELETE /sessions?id=...).
+func SessionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := verifiedEmail(r)
+		var userID int64
+		if err := db.QueryRow("SELECT id FROM users WHERE email=$1", email).Scan(&userID); err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			listSessions(db, userID, w)
+		case "DELETE":
+			revokeSession(db, userID, r.URL.Query().Get("id"), w)
+		default:
+			http.Error(w, "Only GET and DELETE methods are allowed!", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func listSessions(db *sql.DB, userID int64, w http.ResponseWriter) {
+	rows, err := db.Query("SELECT id, created_at FROM sessions WHERE user_id=$1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sessions = append(sessions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func revokeSession(db *sql.DB, userID int64, sessionID string, w http.ResponseWriter) {
+	if sessionID == "" {
+		http.Error(w, "Missing session id", http.StatusBadRequest)
+		return
+	}
+
+	var jti string
+	var refreshJTI sql.NullString
+	err := db.QueryRow(
+		"SELECT jti, refresh_jti FROM sessions WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL",
+		sessionID, userID,
+	).Scan(&jti, &refreshJTI)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := RevokeAccessToken(db, jti, time.Now().Add(accessTokenTTL)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if refreshJTI.Valid {
+		db.Exec("UPDATE refresh_tokens SET revoked_at=NOW() WHERE jti=$1", refreshJTI.String)
+	}
+	db.Exec("UPDATE sessions SET revoked_at=NOW() WHERE id=$1", sessionID)
+
+	w.WriteHeader(http.StatusOK)
+}